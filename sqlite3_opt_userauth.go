@@ -0,0 +1,164 @@
+// Copyright (C) 2018 G.J.R. Timmer <gjr.timmer@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build sqlite_userauth
+
+package sqlite3
+
+/*
+#cgo CFLAGS: -DSQLITE_USER_AUTHENTICATION
+#cgo LDFLAGS: -lm
+#include <sqlite3-binding.h>
+#include <stdlib.h>
+*/
+import "C"
+
+import (
+	"errors"
+	"unsafe"
+)
+
+// ErrUnauthorized is returned when authentication against sqlite_user
+// fails, either because the username is unknown or the password is
+// wrong.
+var ErrUnauthorized = errors.New("sqlite3: SQLITE_AUTH: unauthorized")
+
+// ErrAdminRequired is returned by AuthUserAdd, AuthUserChange and
+// AuthUserDelete when the connection is not currently authenticated as an
+// admin user.
+var ErrAdminRequired = errors.New("sqlite3: SQLITE_AUTH: admin privileges required")
+
+// authenticate is the low-level wrapper around sqlite3_user_authenticate;
+// it does not update c.authUserName/c.authUserIsAdmin, leaving that to its
+// callers, since one of them (store-backed reauthentication, via
+// ensureShadowAdminAuthenticated) authenticates as an internal identity mid-flow without that identity
+// becoming the connection's externally visible user.
+func (c *SQLiteConn) authenticate(username, password string) int {
+	cuser := C.CString(username)
+	defer C.free(unsafe.Pointer(cuser))
+	cpass := C.CString(password)
+	defer C.free(unsafe.Pointer(cpass))
+
+	return int(C.sqlite3_user_authenticate(c.db, cuser, cpass, C.int(len(password))))
+}
+
+// Authenticate authenticates username/password against sqlite_user. When a
+// Hasher has been configured (see SetPasswordHasher in
+// sqlite3_opt_userauth_hash.go), password is verified against the stored
+// hash through that Hasher and SQLite is handed the already-stored value,
+// so its own internal comparison trivially succeeds; with no Hasher
+// configured this reduces to handing SQLite the raw password, letting its
+// built-in hashing do the comparison exactly as before that feature
+// existed.
+func (c *SQLiteConn) Authenticate(username, password string) error {
+	if c.authHasher == nil {
+		rv := c.authenticate(username, password)
+		if rv != C.SQLITE_OK {
+			return ErrUnauthorized
+		}
+		_, isAdmin, err := c.currentUserRow(username)
+		if err != nil {
+			return err
+		}
+		c.authUserName = username
+		c.authUserIsAdmin = isAdmin
+		return nil
+	}
+
+	hash, isAdmin, err := c.currentUserRow(username)
+	if err == errUserRowNotFound {
+		c.verifyPassword("", nil, []byte(password))
+		return ErrUnauthorized
+	}
+	if err != nil {
+		return err
+	}
+	if !c.verifyPassword(username, hash, []byte(password)) {
+		return ErrUnauthorized
+	}
+
+	rv := c.authenticate(username, string(hash))
+	if rv != C.SQLITE_OK {
+		return ErrUnauthorized
+	}
+	c.authUserName = username
+	c.authUserIsAdmin = isAdmin
+	return nil
+}
+
+func (c *SQLiteConn) authUserAdd(username, password string, admin int) int {
+	cuser := C.CString(username)
+	defer C.free(unsafe.Pointer(cuser))
+	cpass := C.CString(password)
+	defer C.free(unsafe.Pointer(cpass))
+
+	return int(C.sqlite3_user_add(c.db, cuser, cpass, C.int(len(password)), C.int(admin)))
+}
+
+// AuthUserAdd adds username as a new user, hashing password through the
+// connection's configured Hasher (if any) before it is handed to
+// sqlite3_user_add. The caller must already be authenticated as an admin
+// user, unless this is the very first user ever added to the database,
+// which SQLite permits unauthenticated so a fresh database can bootstrap
+// its admin account.
+func (c *SQLiteConn) AuthUserAdd(username, password string, admin bool) error {
+	hash, err := c.hashPassword(password)
+	if err != nil {
+		return err
+	}
+	adminFlag := 0
+	if admin {
+		adminFlag = 1
+	}
+	rv := c.authUserAdd(username, string(hash), adminFlag)
+	if rv != C.SQLITE_OK {
+		return ErrAdminRequired
+	}
+	return nil
+}
+
+func (c *SQLiteConn) authUserChange(username, password string, admin int) int {
+	cuser := C.CString(username)
+	defer C.free(unsafe.Pointer(cuser))
+	cpass := C.CString(password)
+	defer C.free(unsafe.Pointer(cpass))
+
+	return int(C.sqlite3_user_change(c.db, cuser, cpass, C.int(len(password)), C.int(admin)))
+}
+
+// AuthUserChange changes username's password and admin flag, hashing
+// password through the connection's configured Hasher (if any) before it
+// is handed to sqlite3_user_change; this is how an existing SHA1 user is
+// migrated to bcrypt, since the next password change run through a
+// bcrypt-configured connection rewrites the stored hash. The caller must
+// already be authenticated as username or as an admin user.
+func (c *SQLiteConn) AuthUserChange(username, password string, admin bool) error {
+	hash, err := c.hashPassword(password)
+	if err != nil {
+		return err
+	}
+	adminFlag := 0
+	if admin {
+		adminFlag = 1
+	}
+	rv := c.authUserChange(username, string(hash), adminFlag)
+	if rv != C.SQLITE_OK {
+		return ErrAdminRequired
+	}
+	return nil
+}
+
+// AuthUserDelete removes username. The caller must already be
+// authenticated as an admin user.
+func (c *SQLiteConn) AuthUserDelete(username string) error {
+	cuser := C.CString(username)
+	defer C.free(unsafe.Pointer(cuser))
+
+	rv := C.sqlite3_user_delete(c.db, cuser)
+	if rv != C.SQLITE_OK {
+		return ErrAdminRequired
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+// Copyright (C) 2018 G.J.R. Timmer <gjr.timmer@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build sqlite_userauth
+
+package sqlite3
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestUserAuthenticationACL(t *testing.T) {
+	var conn *SQLiteConn
+	sql.Register("sqlite3_with_acl",
+		&SQLiteDriver{
+			ConnectHook: func(c *SQLiteConn) error {
+				conn = c
+				return nil
+			},
+		})
+
+	connect := func(f string, username, password string) (file string, db *sql.DB, c *SQLiteConn, err error) {
+		conn = nil
+		file = f
+		if file == "" {
+			file = TempFilename(t)
+		}
+
+		db, err = sql.Open("sqlite3_with_acl", "file:"+file+
+			fmt.Sprintf("?_auth&_auth_acl=1&_auth_user=%s&_auth_pass=%s", username, password))
+		if err != nil {
+			defer os.Remove(file)
+			return file, nil, nil, err
+		}
+
+		if _, err = db.Exec("SELECT 1;"); err != nil {
+			defer os.Remove(file)
+			defer db.Close()
+			return file, nil, nil, err
+		}
+		c = conn
+
+		return
+	}
+
+	Convey("Read/Write Only Granted Tables", t, func() {
+		f1, db1, c1, err := connect("", "admin", "admin")
+		So(f1, ShouldNotBeBlank)
+		So(db1, ShouldNotBeNil)
+		So(c1, ShouldNotBeNil)
+		So(err, ShouldBeNil)
+
+		// Admin sets up the schema and a normal user.
+		_, err = db1.Exec("CREATE TABLE secret (id INTEGER PRIMARY KEY, v TEXT);")
+		So(err, ShouldBeNil)
+		_, err = db1.Exec("CREATE TABLE shared (id INTEGER PRIMARY KEY, v TEXT);")
+		So(err, ShouldBeNil)
+		_, err = db1.Exec("INSERT INTO secret(v) VALUES ('top secret');")
+		So(err, ShouldBeNil)
+		_, err = db1.Exec("INSERT INTO shared(v) VALUES ('hello');")
+		So(err, ShouldBeNil)
+
+		var rv int
+		err = db1.QueryRow("select auth_user_add(?, ?, ?);", "user", "user", 0).Scan(&rv)
+		So(err, ShouldBeNil)
+		So(rv, ShouldEqual, 0)
+
+		// Grant "user" read/write on "shared" only; no access to "secret".
+		err = c1.GrantAccess("user", "shared", true, true)
+		So(err, ShouldBeNil)
+		db1.Close()
+
+		// Reconnect as the normal user.
+		f2, db2, c2, err := connect(f1, "user", "user")
+		So(f2, ShouldNotBeBlank)
+		So(f1, ShouldEqual, f2)
+		So(db2, ShouldNotBeNil)
+		So(c2, ShouldNotBeNil)
+		So(err, ShouldBeNil)
+		defer db2.Close()
+
+		// Reading/writing the granted table succeeds.
+		_, err = db2.Exec("INSERT INTO shared(v) VALUES ('from user');")
+		So(err, ShouldBeNil)
+		var v string
+		err = db2.QueryRow("select v from shared where id = 1;").Scan(&v)
+		So(err, ShouldBeNil)
+		So(v, ShouldEqual, "hello")
+
+		// Reading/writing the ungranted table is denied.
+		err = db2.QueryRow("select v from secret where id = 1;").Scan(&v)
+		So(err, ShouldNotBeNil)
+		_, err = db2.Exec("INSERT INTO secret(v) VALUES ('should fail');")
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Admin Bypasses ACL", t, func() {
+		f1, db1, c1, err := connect("", "admin", "admin")
+		So(f1, ShouldNotBeBlank)
+		So(db1, ShouldNotBeNil)
+		So(c1, ShouldNotBeNil)
+		So(err, ShouldBeNil)
+		defer db1.Close()
+
+		_, err = db1.Exec("CREATE TABLE untouched (id INTEGER PRIMARY KEY);")
+		So(err, ShouldBeNil)
+		_, err = db1.Exec("INSERT INTO untouched DEFAULT VALUES;")
+		So(err, ShouldBeNil)
+	})
+}
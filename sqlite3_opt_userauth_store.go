@@ -0,0 +1,217 @@
+// Copyright (C) 2018 G.J.R. Timmer <gjr.timmer@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build sqlite_userauth
+
+package sqlite3
+
+/*
+#include <sqlite3-binding.h>
+*/
+import "C"
+
+import (
+	"crypto/rand"
+	"database/sql/driver"
+	"errors"
+	"io"
+)
+
+// ErrUserNotFound is returned by a UserStore's Lookup when no user by the
+// given name exists.
+var ErrUserNotFound = errors.New("sqlite3: user not found")
+
+// UserStore lets the userauth build delegate user lookups, additions,
+// changes and deletions to something other than (or in addition to)
+// SQLite's own sqlite_user table, so that a directory of users can be
+// shared across multiple database files. When a SQLiteDriver's UserStore
+// field is set, the login made from the DSN's _auth_user/_auth_pass when a
+// connection is opened consults it and wires the result back through
+// sqlite3_user_authenticate via a credential synthesized from the store's
+// answer (see storeAuthenticate). The SQLiteConn methods Authenticate,
+// AuthUserAdd, AuthUserChange and AuthUserDelete do not consult the store:
+// they act on sqlite_user only and do not update the store.
+type UserStore interface {
+	// Lookup returns the stored password hash and admin flag for
+	// username. It returns ErrUserNotFound if no such user exists.
+	Lookup(username string) (hash []byte, isAdmin bool, err error)
+	Add(username string, hash []byte, isAdmin bool) error
+	Change(username string, hash []byte, isAdmin bool) error
+	Delete(username string) error
+	List() ([]string, error)
+}
+
+// storeAuthenticate authenticates username/password against store instead
+// of sqlite_user, then synthesizes a credential sqlite3_user_authenticate
+// will accept so the rest of the connection (including any installed ACL
+// authorizer) still sees a consistent, successfully authenticated user.
+func (c *SQLiteConn) storeAuthenticate(store UserStore, username, password string) error {
+	hash, isAdmin, err := store.Lookup(username)
+	if err == ErrUserNotFound {
+		c.verifyPassword("", nil, []byte(password)) // pay the same cost as a real lookup
+		return ErrUnauthorized
+	}
+	if err != nil {
+		return err
+	}
+	if !c.verifyPassword(username, hash, []byte(password)) {
+		return ErrUnauthorized
+	}
+
+	if err := c.syncShadowUser(username, hash, isAdmin); err != nil {
+		return err
+	}
+	rv := c.authenticate(username, string(hash))
+	if rv != C.SQLITE_OK {
+		return ErrUnauthorized
+	}
+	c.authUserName = username
+	c.authUserIsAdmin = isAdmin
+	return nil
+}
+
+// syncShadowUser mirrors a UserStore record into sqlite_user so that
+// sqlite3_user_authenticate has a row to compare against; sqlite_user
+// remains SQLite's own bookkeeping table, but the store is the source of
+// truth and is always consulted first.
+//
+// sqlite3_user_add and sqlite3_user_change refuse to run unless the
+// connection is already authenticated as a sqlite_user admin (SQLite
+// waives that only for the very first row ever inserted into
+// sqlite_user). ensureShadowAdminAuthenticated satisfies that requirement
+// using an internal admin identity dedicated to this mirroring, so a
+// store-backed login never depends on the human user already being an
+// admin, or being the first one ever synced.
+func (c *SQLiteConn) syncShadowUser(username string, hash []byte, isAdmin bool) error {
+	if err := c.ensureShadowAdminAuthenticated(); err != nil {
+		return err
+	}
+
+	exists, err := c.currentCredential(username)
+	if err == errUserRowNotFound {
+		return c.authUserAddRaw(username, hash, isAdmin)
+	}
+	if err != nil {
+		return err
+	}
+	if string(exists) == string(hash) {
+		return nil
+	}
+	return c.authUserChangeRaw(username, hash, isAdmin)
+}
+
+// authUserAddRaw and authUserChangeRaw mirror AuthUserAdd/AuthUserChange
+// but accept an already-hashed credential instead of a plaintext password,
+// since a UserStore is responsible for its own hashing and syncShadowUser
+// must not hash an already-hashed value a second time. Callers must have
+// already authenticated the connection as a sqlite_user admin (see
+// ensureShadowAdminAuthenticated); unlike AuthUserAdd/AuthUserChange these
+// do not check c.authUserIsAdmin, since they authenticate as the internal
+// shadow admin rather than the connection's own externally visible user.
+func (c *SQLiteConn) authUserAddRaw(username string, hash []byte, isAdmin bool) error {
+	admin := 0
+	if isAdmin {
+		admin = 1
+	}
+	if rv := c.authUserAdd(username, string(hash), admin); rv != C.SQLITE_OK {
+		return ErrUnauthorized
+	}
+	return nil
+}
+
+func (c *SQLiteConn) authUserChangeRaw(username string, hash []byte, isAdmin bool) error {
+	admin := 0
+	if isAdmin {
+		admin = 1
+	}
+	if rv := c.authUserChange(username, string(hash), admin); rv != C.SQLITE_OK {
+		return ErrUnauthorized
+	}
+	return nil
+}
+
+// shadowAdminSchema creates the single-row table recording the random
+// secret generated for this database's internal shadow admin identity
+// (see ensureShadowAdminAuthenticated). It is never exposed to UserStore
+// callers and carries no human-chosen password.
+const shadowAdminSchema = `
+CREATE TABLE IF NOT EXISTS sqlite_user_store_shadow (
+	id     INTEGER PRIMARY KEY CHECK (id = 0),
+	uname  TEXT NOT NULL,
+	secret BLOB NOT NULL
+);`
+
+// shadowAdminUser is the uname given to the internal admin account
+// syncShadowUser authenticates as before mirroring a UserStore record
+// into sqlite_user. It is a fixed name: storeAuthenticate passes any
+// username, this one included, to the store's Lookup, and nothing here
+// rejects a UserStore user of the same name.
+const shadowAdminUser = "sqlite3_userstore_shadow_admin"
+
+// shadowSecretBytes is the number of random bytes generated for the
+// shadow admin's secret.
+const shadowSecretBytes = 32
+
+// ensureShadowAdminAuthenticated authenticates the connection as the
+// database's internal shadow admin, creating that identity (with a fresh
+// random secret persisted in sqlite_user_store_shadow) the first time it
+// is needed. This satisfies SQLite's own requirement that the caller of
+// sqlite3_user_add/sqlite3_user_change already be an authenticated admin,
+// without depending on the connection's real, externally visible user
+// already being one.
+//
+// It deliberately calls the low-level authenticate rather than
+// Authenticate, so it does not overwrite c.authUserName/c.authUserIsAdmin;
+// the caller (syncShadowUser) runs mid-login, before those are set for
+// the identity now authenticating, and storeAuthenticate re-authenticates
+// as that real identity immediately afterward.
+func (c *SQLiteConn) ensureShadowAdminAuthenticated() error {
+	if _, err := c.Exec(shadowAdminSchema, nil); err != nil {
+		return err
+	}
+
+	uname, secret, err := c.shadowAdminCredential()
+	if err != nil {
+		return err
+	}
+	if uname == "" {
+		uname = shadowAdminUser
+		secret = make([]byte, shadowSecretBytes)
+		if _, err := io.ReadFull(rand.Reader, secret); err != nil {
+			return err
+		}
+		// The very first row ever inserted into sqlite_user is exempt from
+		// SQLite's admin-authenticated-caller requirement, which is what
+		// lets this bootstrap itself.
+		if err := c.authUserAddRaw(uname, secret, true); err != nil {
+			return err
+		}
+		if _, err := c.Exec(
+			`INSERT INTO sqlite_user_store_shadow(id, uname, secret) VALUES (0, ?, ?);`,
+			[]driver.Value{uname, secret},
+		); err != nil {
+			return err
+		}
+	}
+
+	if rv := c.authenticate(uname, string(secret)); rv != C.SQLITE_OK {
+		return ErrUnauthorized
+	}
+	return nil
+}
+
+func (c *SQLiteConn) shadowAdminCredential() (uname string, secret []byte, err error) {
+	rows, err := c.Query(`SELECT uname, secret FROM sqlite_user_store_shadow WHERE id = 0;`, nil)
+	if err != nil {
+		return "", nil, err
+	}
+	defer rows.Close()
+
+	dest := make([]driver.Value, 2)
+	if err := rows.Next(dest); err != nil {
+		return "", nil, nil
+	}
+	return dest[0].(string), dest[1].([]byte), nil
+}
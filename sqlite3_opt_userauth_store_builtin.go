@@ -0,0 +1,224 @@
+// Copyright (C) 2018 G.J.R. Timmer <gjr.timmer@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build sqlite_userauth
+
+package sqlite3
+
+import (
+	"bufio"
+	"database/sql"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// FileUserStore is a UserStore backed by a flat, colon-separated file of
+// the form `user:bcrypthash:role`, one entry per line, following the
+// chasquid-style userdb layout so multiple sqlite3 databases (or other
+// services) can share a single user directory on disk.
+type FileUserStore struct {
+	Path string
+
+	mu sync.Mutex
+}
+
+type fileUserRecord struct {
+	hash    []byte
+	isAdmin bool
+}
+
+func (s *FileUserStore) readAll() (map[string]fileUserRecord, error) {
+	f, err := os.Open(s.Path)
+	if os.IsNotExist(err) {
+		return map[string]fileUserRecord{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	users := make(map[string]fileUserRecord)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		isAdmin, _ := strconv.ParseBool(parts[2])
+		users[parts[0]] = fileUserRecord{hash: []byte(parts[1]), isAdmin: isAdmin}
+	}
+	return users, scanner.Err()
+}
+
+func (s *FileUserStore) writeAll(users map[string]fileUserRecord) error {
+	f, err := os.OpenFile(s.Path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	for user, rec := range users {
+		fmt.Fprintf(w, "%s:%s:%t\n", user, rec.hash, rec.isAdmin)
+	}
+	return w.Flush()
+}
+
+// Lookup implements UserStore.
+func (s *FileUserStore) Lookup(username string) ([]byte, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	users, err := s.readAll()
+	if err != nil {
+		return nil, false, err
+	}
+	rec, ok := users[username]
+	if !ok {
+		return nil, false, ErrUserNotFound
+	}
+	return rec.hash, rec.isAdmin, nil
+}
+
+// Add implements UserStore.
+func (s *FileUserStore) Add(username string, hash []byte, isAdmin bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	users, err := s.readAll()
+	if err != nil {
+		return err
+	}
+	users[username] = fileUserRecord{hash: hash, isAdmin: isAdmin}
+	return s.writeAll(users)
+}
+
+// Change implements UserStore.
+func (s *FileUserStore) Change(username string, hash []byte, isAdmin bool) error {
+	return s.Add(username, hash, isAdmin)
+}
+
+// Delete implements UserStore.
+func (s *FileUserStore) Delete(username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	users, err := s.readAll()
+	if err != nil {
+		return err
+	}
+	delete(users, username)
+	return s.writeAll(users)
+}
+
+// List implements UserStore.
+func (s *FileUserStore) List() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	users, err := s.readAll()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(users))
+	for name := range users {
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// SQLUserStore is a UserStore backed by a table in another database handle
+// (sqlite3 or otherwise), so that a directory of users can live in, e.g.,
+// a central Postgres or MySQL instance shared by several sqlite3-backed
+// services. The table is expected to have (at least) the three columns
+// named below.
+type SQLUserStore struct {
+	DB       *sql.DB
+	Table    string // defaults to "users"
+	UserCol  string // defaults to "username"
+	HashCol  string // defaults to "password_hash"
+	AdminCol string // defaults to "is_admin"
+}
+
+func (s *SQLUserStore) cols() (table, user, hash, admin string) {
+	table, user, hash, admin = s.Table, s.UserCol, s.HashCol, s.AdminCol
+	if table == "" {
+		table = "users"
+	}
+	if user == "" {
+		user = "username"
+	}
+	if hash == "" {
+		hash = "password_hash"
+	}
+	if admin == "" {
+		admin = "is_admin"
+	}
+	return
+}
+
+// Lookup implements UserStore.
+func (s *SQLUserStore) Lookup(username string) ([]byte, bool, error) {
+	table, userCol, hashCol, adminCol := s.cols()
+	var hash []byte
+	var isAdmin bool
+	query := fmt.Sprintf("SELECT %s, %s FROM %s WHERE %s = ?", hashCol, adminCol, table, userCol)
+	err := s.DB.QueryRow(query, username).Scan(&hash, &isAdmin)
+	if err == sql.ErrNoRows {
+		return nil, false, ErrUserNotFound
+	}
+	return hash, isAdmin, err
+}
+
+// Add implements UserStore.
+func (s *SQLUserStore) Add(username string, hash []byte, isAdmin bool) error {
+	table, userCol, hashCol, adminCol := s.cols()
+	query := fmt.Sprintf("INSERT INTO %s (%s, %s, %s) VALUES (?, ?, ?)", table, userCol, hashCol, adminCol)
+	_, err := s.DB.Exec(query, username, hash, isAdmin)
+	return err
+}
+
+// Change implements UserStore.
+func (s *SQLUserStore) Change(username string, hash []byte, isAdmin bool) error {
+	table, userCol, hashCol, adminCol := s.cols()
+	query := fmt.Sprintf("UPDATE %s SET %s = ?, %s = ? WHERE %s = ?", table, hashCol, adminCol, userCol)
+	_, err := s.DB.Exec(query, hash, isAdmin, username)
+	return err
+}
+
+// Delete implements UserStore.
+func (s *SQLUserStore) Delete(username string) error {
+	table, userCol, _, _ := s.cols()
+	query := fmt.Sprintf("DELETE FROM %s WHERE %s = ?", table, userCol)
+	_, err := s.DB.Exec(query, username)
+	return err
+}
+
+// List implements UserStore.
+func (s *SQLUserStore) List() ([]string, error) {
+	table, userCol, _, _ := s.cols()
+	rows, err := s.DB.Query(fmt.Sprintf("SELECT %s FROM %s", userCol, table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
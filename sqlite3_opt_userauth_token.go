@@ -0,0 +1,279 @@
+// Copyright (C) 2018 G.J.R. Timmer <gjr.timmer@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build sqlite_userauth
+
+package sqlite3
+
+/*
+#include <sqlite3-binding.h>
+*/
+import "C"
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/base64"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// ErrTokenExpired is returned by AuthenticateWithToken when the supplied
+// token exists but its expiry has passed.
+var ErrTokenExpired = errors.New("sqlite3: auth token expired")
+
+// ErrTokenInvalid is returned by AuthenticateWithToken when the supplied
+// token does not match any issued token, either because it was never
+// issued or was revoked, or when the token's owner has since been deleted.
+// A token whose owner's password has since changed is rejected with
+// ErrUnauthorized instead.
+var ErrTokenInvalid = errors.New("sqlite3: auth token invalid")
+
+// tokenSchema creates the auxiliary table used to back issued tokens. It
+// is created lazily the first time a token is issued on a connection.
+//
+// cred_fingerprint is sha256 of the sqlite_user.password value current at
+// issue time, not that value itself: sqlite_user_token is otherwise a
+// plain, world-readable table, and storing the actual credential there
+// would hand out a second, never-expiring way to authenticate as the
+// user to anyone who can read it. The fingerprint is only ever used to
+// detect that the password has since changed (see
+// authenticateAsTokenOwner); the credential handed to
+// sqlite3_user_authenticate is always re-read from sqlite_user at
+// authentication time.
+const tokenSchema = `
+CREATE TABLE IF NOT EXISTS sqlite_user_token (
+	user_id          TEXT NOT NULL,
+	token            TEXT NOT NULL PRIMARY KEY,
+	expires          INTEGER NOT NULL,
+	cred_fingerprint BLOB NOT NULL
+);`
+
+// credFingerprint returns a one-way fingerprint of cred suitable for
+// detecting a password change without persisting cred itself.
+func credFingerprint(cred []byte) []byte {
+	sum := sha256.Sum256(cred)
+	return sum[:]
+}
+
+// tokenBytes is the number of random bytes used to generate a token,
+// before base64 encoding.
+const tokenBytes = 32
+
+// IssueAuthToken generates a random token for the currently authenticated
+// user, valid for ttl, and records it in sqlite_user_token so that a
+// fresh connection can trade it for authentication via
+// AuthenticateWithToken without ever carrying the plaintext password.
+func (c *SQLiteConn) IssueAuthToken(ttl time.Duration) (string, error) {
+	if c.authUserName == "" {
+		return "", ErrUnauthorized
+	}
+
+	if _, err := c.Exec(tokenSchema, nil); err != nil {
+		return "", err
+	}
+
+	cred, err := c.currentCredential(c.authUserName)
+	if err == errUserRowNotFound {
+		return "", ErrUnauthorized
+	}
+	if err != nil {
+		return "", err
+	}
+
+	buf := make([]byte, tokenBytes)
+	if _, err := io.ReadFull(rand.Reader, buf); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf)
+
+	expires := time.Now().Add(ttl).Unix()
+	_, err = c.Exec(
+		`INSERT INTO sqlite_user_token(user_id, token, expires, cred_fingerprint) VALUES (?, ?, ?, ?);`,
+		[]driver.Value{c.authUserName, token, expires, credFingerprint(cred)},
+	)
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// currentCredential returns the password column currently stored for user
+// in sqlite_user, used both to derive the credential handed to
+// sqlite3_user_authenticate and to detect a password change that should
+// invalidate any tokens issued against the old credential.
+func (c *SQLiteConn) currentCredential(user string) (cred []byte, err error) {
+	err = c.withACLBypass(func() error {
+		rows, queryErr := c.Query(`SELECT password FROM sqlite_user WHERE uname = ?;`, []driver.Value{user})
+		if queryErr != nil {
+			return queryErr
+		}
+		defer rows.Close()
+
+		dest := make([]driver.Value, 1)
+		if nextErr := rows.Next(dest); nextErr != nil {
+			return errUserRowNotFound
+		}
+		cred = dest[0].([]byte)
+		return nil
+	})
+	return cred, err
+}
+
+// errUserRowNotFound is the internal sentinel returned by
+// currentCredential when sqlite_user has no row for the requested user.
+var errUserRowNotFound = errors.New("sqlite3: no such user in sqlite_user")
+
+// RevokeAuthToken deletes token, if present, so it can no longer be used
+// to authenticate a new connection.
+func (c *SQLiteConn) RevokeAuthToken(token string) error {
+	_, err := c.Exec(`DELETE FROM sqlite_user_token WHERE token = ?;`, []driver.Value{token})
+	return err
+}
+
+// ExtendAuthToken pushes token's expiry out by ttl from now. It returns
+// ErrTokenInvalid if the token does not exist.
+func (c *SQLiteConn) ExtendAuthToken(token string, ttl time.Duration) error {
+	expires := time.Now().Add(ttl).Unix()
+	res, err := c.Exec(`UPDATE sqlite_user_token SET expires = ? WHERE token = ?;`, []driver.Value{expires, token})
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrTokenInvalid
+	}
+	return nil
+}
+
+// AuthenticateWithToken authenticates the connection using a token
+// previously returned by IssueAuthToken, instead of a plaintext password.
+// It looks the token up, rejects it if expired or unknown, and otherwise
+// authenticates as the token's owner.
+func (c *SQLiteConn) AuthenticateWithToken(token string) error {
+	user, expires, fingerprint, ok, err := c.lookupToken(token)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrTokenInvalid
+	}
+	if time.Now().Unix() > expires {
+		return ErrTokenExpired
+	}
+	return c.authenticateAsTokenOwner(user, fingerprint)
+}
+
+func (c *SQLiteConn) lookupToken(token string) (user string, expires int64, fingerprint []byte, ok bool, err error) {
+	rows, err := c.Query(`SELECT user_id, expires, cred_fingerprint FROM sqlite_user_token WHERE token = ?;`, []driver.Value{token})
+	if err != nil {
+		return "", 0, nil, false, err
+	}
+	defer rows.Close()
+
+	dest := make([]driver.Value, 3)
+	if err := rows.Next(dest); err != nil {
+		if err == io.EOF {
+			return "", 0, nil, false, nil
+		}
+		return "", 0, nil, false, err
+	}
+	return dest[0].(string), dest[1].(int64), dest[2].([]byte), true, nil
+}
+
+// authenticateAsTokenOwner completes authentication as user, provided
+// fingerprint (computed from the credential current when the token was
+// issued) still matches the fingerprint of what is currently stored for
+// user in sqlite_user. If AuthUserChange has since rotated the password,
+// the fingerprints won't match and the token is rejected rather than
+// silently authenticating against stale state.
+//
+// The credential itself is always re-read from sqlite_user here, never
+// taken from the token row, since sqlite_user_token never stores it.
+func (c *SQLiteConn) authenticateAsTokenOwner(user string, fingerprint []byte) error {
+	current, err := c.currentCredential(user)
+	if err == errUserRowNotFound {
+		// The user was deleted (AuthUserDelete) after the token was
+		// issued; there is no credential left to compare against.
+		return ErrTokenInvalid
+	}
+	if err != nil {
+		return err
+	}
+	if string(credFingerprint(current)) != string(fingerprint) {
+		return ErrUnauthorized
+	}
+
+	rv := c.authenticate(user, string(current))
+	switch rv {
+	case C.SQLITE_OK:
+		_, isAdmin, err := c.currentUserRow(user)
+		if err != nil {
+			return err
+		}
+		c.authUserName = user
+		c.authUserIsAdmin = isAdmin
+		return nil
+	default:
+		return ErrUnauthorized
+	}
+}
+
+// sweepExpiredTokens removes every token whose expiry has passed. It is
+// run periodically by a TokenSweeper rather than on every authentication
+// attempt, so that a busy connection pool doesn't pay the cost of the
+// DELETE on every request.
+func (c *SQLiteConn) sweepExpiredTokens() error {
+	_, err := c.Exec(`DELETE FROM sqlite_user_token WHERE expires < ?;`, []driver.Value{time.Now().Unix()})
+	return err
+}
+
+// TokenSweeper periodically purges expired rows from sqlite_user_token in
+// the background, so a long-lived process that issues many tokens doesn't
+// grow that table without bound.
+type TokenSweeper struct {
+	conn     *SQLiteConn
+	ticker   *time.Ticker
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// StartTokenSweeper launches a background goroutine that calls
+// conn.sweepExpiredTokens every interval, until Stop is called. The
+// caller is responsible for calling Stop before closing conn.
+func StartTokenSweeper(conn *SQLiteConn, interval time.Duration) *TokenSweeper {
+	s := &TokenSweeper{
+		conn:   conn,
+		ticker: time.NewTicker(interval),
+		done:   make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+func (s *TokenSweeper) run() {
+	for {
+		select {
+		case <-s.ticker.C:
+			s.conn.sweepExpiredTokens()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// Stop halts the background sweep. It is safe to call more than once.
+func (s *TokenSweeper) Stop() {
+	s.stopOnce.Do(func() {
+		s.ticker.Stop()
+		close(s.done)
+	})
+}
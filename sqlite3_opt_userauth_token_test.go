@@ -0,0 +1,155 @@
+// Copyright (C) 2018 G.J.R. Timmer <gjr.timmer@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build sqlite_userauth
+
+package sqlite3
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestUserAuthenticationToken(t *testing.T) {
+	var conn *SQLiteConn
+	sql.Register("sqlite3_with_token",
+		&SQLiteDriver{
+			ConnectHook: func(c *SQLiteConn) error {
+				conn = c
+				return nil
+			},
+		})
+
+	connect := func(f string, dsnExtra string) (file string, db *sql.DB, c *SQLiteConn, err error) {
+		conn = nil
+		file = f
+		if file == "" {
+			file = TempFilename(t)
+		}
+
+		db, err = sql.Open("sqlite3_with_token", "file:"+file+"?"+dsnExtra)
+		if err != nil {
+			defer os.Remove(file)
+			return file, nil, nil, err
+		}
+
+		if _, err = db.Exec("SELECT 1;"); err != nil {
+			defer os.Remove(file)
+			defer db.Close()
+			return file, nil, nil, err
+		}
+		c = conn
+
+		return
+	}
+
+	Convey("Issue and Authenticate With Token", t, func() {
+		f1, db1, c1, err := connect("", "_auth&_auth_user=admin&_auth_pass=admin")
+		So(f1, ShouldNotBeBlank)
+		So(db1, ShouldNotBeNil)
+		So(c1, ShouldNotBeNil)
+		So(err, ShouldBeNil)
+		defer db1.Close()
+
+		token, err := c1.IssueAuthToken(time.Hour)
+		So(err, ShouldBeNil)
+		So(token, ShouldNotBeBlank)
+
+		f2, db2, c2, err := connect(f1, fmt.Sprintf("_auth&_auth_token=%s", token))
+		So(f2, ShouldEqual, f1)
+		So(db2, ShouldNotBeNil)
+		So(c2, ShouldNotBeNil)
+		So(err, ShouldBeNil)
+		defer db2.Close()
+	})
+
+	Convey("Expired Token Is Rejected", t, func() {
+		f1, db1, c1, err := connect("", "_auth&_auth_user=admin&_auth_pass=admin")
+		So(err, ShouldBeNil)
+		defer db1.Close()
+
+		token, err := c1.IssueAuthToken(-time.Minute)
+		So(err, ShouldBeNil)
+
+		err = c1.AuthenticateWithToken(token)
+		So(err, ShouldEqual, ErrTokenExpired)
+		_ = f1
+	})
+
+	Convey("Revoked Token Is Rejected", t, func() {
+		f1, db1, c1, err := connect("", "_auth&_auth_user=admin&_auth_pass=admin")
+		So(err, ShouldBeNil)
+		defer db1.Close()
+
+		token, err := c1.IssueAuthToken(time.Hour)
+		So(err, ShouldBeNil)
+
+		err = c1.RevokeAuthToken(token)
+		So(err, ShouldBeNil)
+
+		err = c1.AuthenticateWithToken(token)
+		So(err, ShouldEqual, ErrTokenInvalid)
+		_ = f1
+	})
+
+	Convey("Token Rejected After Password Change", t, func() {
+		f1, db1, c1, err := connect("", "_auth&_auth_user=admin&_auth_pass=admin")
+		So(err, ShouldBeNil)
+		defer db1.Close()
+
+		token, err := c1.IssueAuthToken(time.Hour)
+		So(err, ShouldBeNil)
+
+		err = c1.AuthUserChange("admin", "nimda", true)
+		So(err, ShouldBeNil)
+
+		err = c1.AuthenticateWithToken(token)
+		So(err, ShouldEqual, ErrUnauthorized)
+		_ = f1
+	})
+
+	Convey("Token Rejected After User Deleted", t, func() {
+		f1, db1, c1, err := connect("", "_auth&_auth_user=admin&_auth_pass=admin")
+		So(err, ShouldBeNil)
+		defer db1.Close()
+
+		err = c1.AuthUserAdd("user", "user", false)
+		So(err, ShouldBeNil)
+
+		_, db2, c2, err := connect(f1, "_auth&_auth_user=user&_auth_pass=user")
+		So(err, ShouldBeNil)
+
+		token, err := c2.IssueAuthToken(time.Hour)
+		So(err, ShouldBeNil)
+		db2.Close()
+
+		err = c1.AuthUserDelete("user")
+		So(err, ShouldBeNil)
+
+		err = c1.AuthenticateWithToken(token)
+		So(err, ShouldEqual, ErrTokenInvalid)
+	})
+
+	Convey("Background Sweeper Purges Expired Tokens", t, func() {
+		_, db1, c1, err := connect("", "_auth&_auth_user=admin&_auth_pass=admin")
+		So(err, ShouldBeNil)
+		defer db1.Close()
+
+		token, err := c1.IssueAuthToken(-time.Minute)
+		So(err, ShouldBeNil)
+
+		sweeper := StartTokenSweeper(c1, 10*time.Millisecond)
+		defer sweeper.Stop()
+		time.Sleep(50 * time.Millisecond)
+
+		err = c1.AuthenticateWithToken(token)
+		So(err, ShouldEqual, ErrTokenInvalid)
+	})
+}